@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// chatRateLimit is the per-client token bucket refill rate, in
+// messages/sec, applied only to chat (presence and signaling are left
+// alone since they're not something a user can spam by hand).
+var chatRateLimit = getEnvFloat("CHAT_RATE_LIMIT", 5)
+
+// chatBacklogSize caps how many recent chat messages per room are kept
+// so a late joiner can catch up.
+var chatBacklogSize = getEnvInt("CHAT_BACKLOG_SIZE", 50)
+
+type rateLimiter struct {
+	mu       sync.Mutex
+	tokens   float64
+	rate     float64
+	lastSeen time.Time
+	notified bool
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{tokens: rate, rate: rate, lastSeen: time.Now()}
+}
+
+func (rl *rateLimiter) allow() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.lastSeen).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.lastSeen = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	rl.notified = false
+	return true
+}
+
+// denyNotice reports whether a rejected message is the first since the
+// limiter last allowed one, so a client spamming chat gets a single
+// "rateLimited" notice instead of one per dropped message.
+func (rl *rateLimiter) denyNotice() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.notified {
+		return false
+	}
+	rl.notified = true
+	return true
+}
+
+var (
+	chatLimitersMu sync.Mutex
+	chatLimiters   = make(map[string]*rateLimiter)
+)
+
+func chatLimiterFor(clientId string) *rateLimiter {
+	chatLimitersMu.Lock()
+	defer chatLimitersMu.Unlock()
+
+	rl, ok := chatLimiters[clientId]
+	if !ok {
+		rl = newRateLimiter(chatRateLimit)
+		chatLimiters[clientId] = rl
+	}
+	return rl
+}
+
+// clearChatLimiter drops clientId's rate limiter so chatLimiters doesn't
+// grow without bound as clients join and disconnect.
+func clearChatLimiter(clientId string) {
+	chatLimitersMu.Lock()
+	defer chatLimitersMu.Unlock()
+
+	delete(chatLimiters, clientId)
+}
+
+var (
+	chatBacklogMu sync.Mutex
+	chatBacklog   = make(map[string][]Message)
+)
+
+func appendChatBacklog(roomId string, msg Message) {
+	chatBacklogMu.Lock()
+	defer chatBacklogMu.Unlock()
+
+	buf := append(chatBacklog[roomId], msg)
+	if len(buf) > chatBacklogSize {
+		buf = buf[len(buf)-chatBacklogSize:]
+	}
+	chatBacklog[roomId] = buf
+}
+
+func chatBacklogFor(roomId string) []Message {
+	chatBacklogMu.Lock()
+	defer chatBacklogMu.Unlock()
+
+	buf := chatBacklog[roomId]
+	out := make([]Message, len(buf))
+	copy(out, buf)
+	return out
+}
+
+// sendChatBacklog sends a joining client the room's client list and
+// then replays recent room chat right after it, so it can render
+// history before any live messages arrive.
+func sendChatBacklog(client *Client) {
+	sendClientList(client.Id, client.RoomId)
+	for _, msg := range chatBacklogFor(client.RoomId) {
+		client.enqueue(msg)
+	}
+}
+
+// handleChat routes a chat message to one clientId in the sender's room,
+// or broadcasts it to the whole room if ClientId is empty. forwardMessage
+// is not reused here because it is restricted to signaling types and
+// doesn't backlog.
+func handleChat(senderID string, msg Message) {
+	clientsMu.Lock()
+	sender := clients[senderID]
+	clientsMu.Unlock()
+
+	if sender == nil || sender.RoomId == "" {
+		return
+	}
+
+	rl := chatLimiterFor(senderID)
+	if !rl.allow() {
+		// Throttle, don't disconnect: tripping the chat rate limit is
+		// not a permission violation, so it shouldn't cost the client
+		// its WebRTC session the way denyAction would. Only the first
+		// rejection in a burst gets a notice, so the notice itself
+		// can't flood the same write buffer it's warning about.
+		if rl.denyNotice() {
+			sender.enqueue(Message{Type: TypeChat, Kind: "rateLimited", SenderId: senderID})
+		}
+		return
+	}
+
+	msg.SenderId = senderID
+	msg.RoomId = sender.RoomId
+	msg.Timestamp = time.Now().Unix()
+
+	if msg.ClientId != "" {
+		clientsMu.Lock()
+		target := clients[msg.ClientId]
+		clientsMu.Unlock()
+
+		if target == nil || target.RoomId != sender.RoomId {
+			log.Printf("Chat target %s not in room %s", msg.ClientId, sender.RoomId)
+			return
+		}
+		target.enqueue(msg)
+		return
+	}
+
+	// Only room-wide chat is backlogged: a directed message above is
+	// delivered to its one recipient and must never be replayed to
+	// whoever joins the room later.
+	appendChatBacklog(sender.RoomId, msg)
+	broadcastToRoom(sender.RoomId, msg, nil)
+}
+
+// handlePresence broadcasts an idle/typing/hand-raised style status
+// update to the rest of the sender's room.
+func handlePresence(senderID string, msg Message) {
+	clientsMu.Lock()
+	sender := clients[senderID]
+	clientsMu.Unlock()
+
+	if sender == nil || sender.RoomId == "" {
+		return
+	}
+
+	msg.SenderId = senderID
+	msg.RoomId = sender.RoomId
+	broadcastToRoom(sender.RoomId, msg, []string{senderID})
+}
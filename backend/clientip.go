@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies holds the CIDRs of reverse proxies allowed to tell us
+// the real client IP via X-Forwarded-For/X-Real-IP. Anything else gets
+// taken at face value from RemoteAddr, since otherwise anyone could
+// spoof those headers.
+var trustedProxies = parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Invalid entry in TRUSTED_PROXIES %q: %v", cidr, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func isTrustedProxy(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the real client IP for r. If the immediate
+// peer isn't a trusted proxy, RemoteAddr is the only thing we can trust
+// and is returned as-is. Otherwise we walk X-Forwarded-For right to
+// left, skipping hops that are themselves trusted proxies, and stop at
+// the first one that isn't; X-Real-IP is the fallback when there's no
+// usable X-Forwarded-For.
+func resolveClientIP(r *http.Request) string {
+	peerIP := stripPort(r.RemoteAddr)
+	if !isTrustedProxy(peerIP) {
+		return peerIP
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" || isTrustedProxy(hop) {
+				continue
+			}
+			return hop
+		}
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+		return real
+	}
+
+	return peerIP
+}
+
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
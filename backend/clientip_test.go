@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = parseTrustedProxies("10.0.0.0/8,::1/128")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		xRealIP    string
+		want       string
+	}{
+		{
+			name:       "untrusted peer ignores forwarded headers",
+			remoteAddr: "203.0.113.5:4321",
+			xff:        "198.51.100.9",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy, single forwarded hop",
+			remoteAddr: "10.0.0.1:4321",
+			xff:        "198.51.100.9",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted proxy chain, right-to-left walk skips trusted hops",
+			remoteAddr: "10.0.0.1:4321",
+			xff:        "198.51.100.9, 10.0.0.2, 10.0.0.1",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "spoofed client-claimed hop after the real client is ignored",
+			remoteAddr: "10.0.0.1:4321",
+			xff:        "6.6.6.6, 198.51.100.9, 10.0.0.1",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted proxy falls back to X-Real-IP with no usable XFF",
+			remoteAddr: "10.0.0.1:4321",
+			xRealIP:    "198.51.100.9",
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "trusted proxy with no forwarding headers falls back to RemoteAddr",
+			remoteAddr: "10.0.0.1:4321",
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xRealIP != "" {
+				r.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			if got := resolveClientIP(r); got != tt.want {
+				t.Errorf("resolveClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = parseTrustedProxies("10.0.0.0/8")
+
+	if !isTrustedProxy("10.1.2.3") {
+		t.Error("expected 10.1.2.3 to be trusted")
+	}
+	if isTrustedProxy("11.1.2.3") {
+		t.Error("expected 11.1.2.3 to not be trusted")
+	}
+	if isTrustedProxy("not-an-ip") {
+		t.Error("expected garbage input to not be trusted")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolError means the client sent something outside the protocol:
+// an unknown message type, a stale room join, a message aimed at a
+// client that doesn't exist (anymore).
+type ProtocolError struct{ Message string }
+
+func (e *ProtocolError) Error() string { return e.Message }
+
+// UserError means the client asked for something it isn't allowed to
+// do: missing permission, bad/expired room token.
+type UserError struct{ Message string }
+
+func (e *UserError) Error() string { return e.Message }
+
+// KickError means an op removed the client on purpose.
+type KickError struct{ Message string }
+
+func (e *KickError) Error() string { return e.Message }
+
+// closeCodeFor picks the WebSocket close code that best matches err's
+// type, mirroring how galene's errorToWSCloseMessage dispatches on
+// error type rather than always closing with the same generic code.
+func closeCodeFor(err error) int {
+	switch err.(type) {
+	case *ProtocolError:
+		return websocket.CloseProtocolError
+	case *UserError, *KickError:
+		return websocket.CloseNormalClosure
+	default:
+		return websocket.CloseInternalServerErr
+	}
+}
+
+func kindFor(err error) string {
+	switch err.(type) {
+	case *ProtocolError:
+		return "protocolError"
+	case *KickError:
+		return "kicked"
+	default:
+		return "error"
+	}
+}
+
+const maxCloseReasonBytes = 123
+
+func closeReason(err error) string {
+	s := err.Error()
+	if len(s) > maxCloseReasonBytes {
+		s = s[:maxCloseReasonBytes]
+	}
+	return s
+}
+
+// closeClientWithErr sends an in-band {type:"error", kind, message}
+// frame through the client's write pump, then closes the connection
+// with a close code chosen from err's type and the same message as the
+// close reason, so the JS client can display it even if it misses the
+// in-band frame. It uses closeGracefully rather than evict so the
+// writer is guaranteed to flush both queued frames before the
+// connection actually goes away.
+func closeClientWithErr(client *Client, err error) {
+	if client == nil {
+		return
+	}
+	client.enqueue(Message{Type: TypeError, Kind: kindFor(err), Message: err.Error()})
+	client.enqueue(closeFrame(websocket.FormatCloseMessage(closeCodeFor(err), closeReason(err))))
+	client.closeGracefully()
+}
+
+// closeConnWithErr is closeClientWithErr for a connection that never
+// made it into the clients map, so it has no write pump to go through.
+func closeConnWithErr(conn *websocket.Conn, err error) {
+	payload, marshalErr := json.Marshal(Message{Type: TypeError, Kind: kindFor(err), Message: err.Error()})
+	if marshalErr == nil {
+		conn.WriteMessage(websocket.TextMessage, payload)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(closeCodeFor(err), closeReason(err)))
+}
+
+// rejectClient closes whichever connection is responsible for clientId:
+// its registered Client if it has one, otherwise the raw conn it sent
+// the offending message on.
+func rejectClient(conn *websocket.Conn, clientId string, err error) {
+	clientsMu.Lock()
+	client := clients[clientId]
+	clientsMu.Unlock()
+
+	if client != nil {
+		closeClientWithErr(client, err)
+		return
+	}
+	closeConnWithErr(conn, err)
+}
+
+func denyAction(client *Client, action string) {
+	closeClientWithErr(client, &UserError{Message: fmt.Sprintf("not permitted: %s", action)})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ICEServerConfig is the on-disk shape of ICE_CONFIG. A "hmac-sha1" entry
+// carries a long-lived shared secret instead of static credentials, and
+// gets turned into short-lived per-client creds by iceServersFor.
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	Kind       string   `json:"kind,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	TTLSeconds int64    `json:"ttlSeconds,omitempty"`
+}
+
+// ICEServer is what actually goes out over the wire to a client.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+var (
+	iceConfigPath = getEnv("ICE_CONFIG", "")
+	iceConfigMu   sync.RWMutex
+	iceConfig     []ICEServerConfig
+)
+
+func loadICEConfig() {
+	if iceConfigPath == "" {
+		return
+	}
+	data, err := os.ReadFile(iceConfigPath)
+	if err != nil {
+		log.Printf("Error reading ICE_CONFIG %s: %v", iceConfigPath, err)
+		return
+	}
+	var cfg []ICEServerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Error parsing ICE_CONFIG %s: %v", iceConfigPath, err)
+		return
+	}
+
+	iceConfigMu.Lock()
+	iceConfig = cfg
+	iceConfigMu.Unlock()
+	log.Printf("Loaded %d ICE server(s) from %s", len(cfg), iceConfigPath)
+}
+
+// watchICEConfigReload does the initial load and then reloads ICE_CONFIG
+// on every SIGHUP, so operators can rotate TURN secrets without a restart.
+func watchICEConfigReload() {
+	if iceConfigPath == "" {
+		return
+	}
+	loadICEConfig()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			loadICEConfig()
+		}
+	}()
+}
+
+// iceServersFor resolves the configured ICE servers for clientId,
+// minting fresh TURN REST API credentials for any "hmac-sha1" entry so
+// the long-lived secret never reaches a client.
+func iceServersFor(clientId string) []ICEServer {
+	iceConfigMu.RLock()
+	defer iceConfigMu.RUnlock()
+
+	servers := make([]ICEServer, 0, len(iceConfig))
+	for _, entry := range iceConfig {
+		if entry.Kind == "hmac-sha1" && entry.Secret != "" {
+			username, credential := turnRESTCredentials(entry.Secret, clientId, entry.TTLSeconds)
+			servers = append(servers, ICEServer{URLs: entry.URLs, Username: username, Credential: credential})
+			continue
+		}
+		servers = append(servers, ICEServer{URLs: entry.URLs, Username: entry.Username, Credential: entry.Credential})
+	}
+	return servers
+}
+
+// turnRESTCredentials implements the coturn long-term TURN REST API
+// credential mechanism: username is "<expiry>:<clientId>", credential is
+// base64(HMAC-SHA1(secret, username)).
+func turnRESTCredentials(secret, clientId string, ttlSeconds int64) (string, string) {
+	if ttlSeconds <= 0 {
+		ttlSeconds = 86400
+	}
+	expiry := time.Now().Add(time.Duration(ttlSeconds) * time.Second).Unix()
+	username := fmt.Sprintf("%d:%s", expiry, clientId)
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return username, credential
+}
+
+func sendICEServers(client *Client) {
+	servers := iceServersFor(client.Id)
+	if len(servers) == 0 {
+		return
+	}
+	client.enqueue(Message{Type: TypeICEServers, IceServers: servers})
+}
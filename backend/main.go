@@ -6,7 +6,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,26 +20,168 @@ var (
 	}
 	clients   = make(map[string]*Client)
 	clientsMu sync.Mutex
+
+	rooms = make(map[string]*Room)
+
+	writeWait  = getEnvDuration("WRITE_DEADLINE", 10*time.Second)
+	pingPeriod = getEnvDuration("PING_PERIOD", 54*time.Second)
 )
 
+const clientSendBuffer = 32
+
 type Client struct {
-	Id     string
-	RoomId string
-	Conn   *websocket.Conn
+	Id          string
+	RoomId      string
+	Conn        *websocket.Conn
+	Permissions []string
+	IP          string
+
+	writeCh   chan interface{}
+	writeMu   sync.RWMutex // guards writeCh against a send racing its close
+	closed    bool
+	closeOnce sync.Once
 }
 
 func NewClient(id string, roomId string, conn *websocket.Conn) *Client {
-	return &Client{Id: id, RoomId: roomId, Conn: conn}
+	c := &Client{
+		Id:      id,
+		RoomId:  roomId,
+		Conn:    conn,
+		writeCh: make(chan interface{}, clientSendBuffer),
+	}
+	go c.writer()
+	return c
+}
+
+func (c *Client) hasPermission(permission string) bool {
+	if c == nil {
+		return false
+	}
+	return contains(c.Permissions, permission)
+}
+
+// Room tracks the one piece of per-room state that isn't derivable from
+// the clients map: who the op is. Rooms are created implicitly by the
+// first createRoom or joinRoomWithToken for a room id and are never
+// removed, even after their last client has disconnected.
+type Room struct {
+	Op string
+}
+
+func defaultPermissions(isOp bool) []string {
+	if isOp {
+		return []string{PermissionPresent, PermissionRecord, PermissionOp}
+	}
+	return []string{PermissionPresent}
+}
+
+// writer is the only goroutine allowed to write to Conn. Every other
+// goroutine must go through enqueue so writes stay serialized. On the
+// graceful path (closeGracefully) it is the one that closes Conn, and
+// only after writeCh is closed and drained, so a close-frame queued
+// right before shutdown is not lost to a race with the shutdown signal
+// itself. evict, by contrast, closes Conn directly without draining.
+func (c *Client) writer() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer c.Conn.Close()
+
+	for {
+		select {
+		case msg, ok := <-c.writeCh:
+			if !ok {
+				return
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeOne(msg); err != nil {
+				log.Printf("Error writing to client %s: %v", c.Id, err)
+				c.evict()
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.evict()
+				return
+			}
+		}
+	}
+}
+
+// closeFrame marks a payload that must go out as a WebSocket close frame
+// rather than a text frame, so enqueue/writer can tell them apart.
+type closeFrame []byte
+
+func (c *Client) writeOne(v interface{}) error {
+	switch m := v.(type) {
+	case closeFrame:
+		return c.Conn.WriteMessage(websocket.CloseMessage, m)
+	case []byte:
+		return c.Conn.WriteMessage(websocket.TextMessage, m)
+	default:
+		return c.Conn.WriteJSON(m)
+	}
+}
+
+// enqueue offers v to the client's write pump without blocking the
+// calling goroutine. A full buffer means the peer isn't draining fast
+// enough, so we cut it loose instead of stalling everyone behind it.
+// The writeMu read-lock makes this safe to call concurrently with
+// evict/closeGracefully: once one of those has flipped closed, enqueue
+// never touches writeCh again, so it can't send on a closed channel.
+func (c *Client) enqueue(v interface{}) {
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.writeCh <- v:
+	default:
+		log.Printf("Client %s write buffer full, evicting", c.Id)
+		go c.evict()
+	}
+}
+
+// evict force-closes the connection right away: the peer isn't
+// draining (full write buffer) or the connection is already broken, so
+// there's nothing worth waiting on. The blocked reader in
+// handleConnections then unwinds and runs the normal disconnection
+// path.
+func (c *Client) evict() {
+	c.closeOnce.Do(func() {
+		c.closeWriteCh()
+		c.Conn.Close()
+	})
+}
+
+// closeGracefully stops accepting further writes and closes writeCh
+// without touching Conn, so the writer drains whatever is already
+// queued (e.g. an error frame followed by a close frame) and closes
+// Conn itself only once that queue is empty. Use this after a final
+// enqueue whose frames must reach the peer; use evict when the
+// connection is already lost and there's nothing to drain.
+func (c *Client) closeGracefully() {
+	c.closeOnce.Do(c.closeWriteCh)
+}
+
+func (c *Client) closeWriteCh() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.closed = true
+	close(c.writeCh)
 }
 
 type MessageType string
 
 const (
-	TypeNewClient  MessageType = "newClient"
-	TypeGetClients MessageType = "getClients"
-	TypeClients    MessageType = "clients"
-	TypeCreateRoom MessageType = "createRoom"
-	TypeJoinRoom   MessageType = "joinRoom"
+	TypeNewClient         MessageType = "newClient"
+	TypeGetClients        MessageType = "getClients"
+	TypeClients           MessageType = "clients"
+	TypeCreateRoom        MessageType = "createRoom"
+	TypeJoinRoom          MessageType = "joinRoom"
+	TypeJoinRoomWithToken MessageType = "joinRoomWithToken"
 )
 
 const (
@@ -46,19 +190,55 @@ const (
 	TypeCandidate MessageType = "candidate"
 )
 
+const (
+	TypeSetPermissions MessageType = "setPermissions"
+	TypeKick           MessageType = "kick"
+)
+
+// TypeError is the in-band frame sent right before a connection is
+// closed for a protocol/permission/kick error; see errors.go.
+const TypeError MessageType = "error"
+
+const TypeICEServers MessageType = "iceServers"
+
+const (
+	TypeChat     MessageType = "chat"
+	TypePresence MessageType = "presence"
+)
+
+// permissions a client in a room can hold. "op" additionally grants the
+// right to call setPermissions/kick on other clients in the same room.
+const (
+	PermissionPresent = "present"
+	PermissionRecord  = "record"
+	PermissionOp      = "op"
+	PermissionObserve = "observe"
+)
+
 type Message struct {
-	Type      MessageType     `json:"type"`
-	ClientId  string          `json:"clientId,omitempty"`
-	SenderId  string          `json:"senderId,omitempty"`
-	RoomId    string          `json:"roomId,omitempty"`
-	Clients   []string        `json:"clients,omitempty"`
-	Offer     json.RawMessage `json:"offer,omitempty"`
-	Answer    json.RawMessage `json:"answer,omitempty"`
-	Candidate json.RawMessage `json:"candidate,omitempty"`
+	Type              MessageType         `json:"type"`
+	ClientId          string              `json:"clientId,omitempty"`
+	SenderId          string              `json:"senderId,omitempty"`
+	RoomId            string              `json:"roomId,omitempty"`
+	Clients           []string            `json:"clients,omitempty"`
+	ClientPermissions map[string][]string `json:"clientPermissions,omitempty"`
+	Permissions       []string            `json:"permissions,omitempty"`
+	Kind              string              `json:"kind,omitempty"`
+	Message           string              `json:"message,omitempty"`
+	Token             string              `json:"token,omitempty"`
+	IceServers        []ICEServer         `json:"iceServers,omitempty"`
+	Timestamp         int64               `json:"timestamp,omitempty"`
+	Offer             json.RawMessage     `json:"offer,omitempty"`
+	Answer            json.RawMessage     `json:"answer,omitempty"`
+	Candidate         json.RawMessage     `json:"candidate,omitempty"`
 }
 
 func main() {
+	watchICEConfigReload()
+
 	http.HandleFunc("/", handleConnections)
+	http.HandleFunc("/token", handleMintToken)
+	http.HandleFunc("/stats", handleStats)
 	fmt.Printf("WebSocket server is running on port %s\n", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
@@ -71,7 +251,8 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	log.Println("New connection established", r.RemoteAddr)
+	ip := resolveClientIP(r)
+	log.Println("New connection established", ip)
 
 	var senderID string
 
@@ -79,66 +260,229 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		var msg Message
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Error reading message: %v", err)
+			}
 			handleClientDisconnection(conn)
 			break
 		}
 		log.Printf("Message received: %+v", msg)
 
-		if msg.Type == TypeCreateRoom || msg.Type == TypeJoinRoom {
+		if msg.Type == TypeCreateRoom || msg.Type == TypeJoinRoom || msg.Type == TypeJoinRoomWithToken {
 			senderID = msg.ClientId
 		}
 
 		switch msg.Type {
-		case TypeCreateRoom, TypeJoinRoom:
-			handleRoomOperation(conn, msg.ClientId, msg.RoomId)
+		case TypeCreateRoom:
+			handleRoomOperation(conn, ip, msg.ClientId, msg.RoomId, true)
+		case TypeJoinRoom:
+			handleRoomOperation(conn, ip, msg.ClientId, msg.RoomId, false)
+		case TypeJoinRoomWithToken:
+			handleJoinRoomWithToken(conn, ip, msg)
 		case TypeGetClients:
-			sendClientList(conn, msg.RoomId)
+			sendClientList(msg.ClientId, msg.RoomId)
 		case TypeOffer, TypeAnswer, TypeCandidate:
 			forwardMessage(senderID, msg)
+		case TypeSetPermissions:
+			handleSetPermissions(senderID, msg)
+		case TypeKick:
+			handleKick(senderID, msg)
+		case TypeChat:
+			handleChat(senderID, msg)
+		case TypePresence:
+			handlePresence(senderID, msg)
 		default:
 			log.Printf("Unknown message type: %s", msg.Type)
+			rejectClient(conn, senderID, &ProtocolError{Message: fmt.Sprintf("unknown message type: %s", msg.Type)})
 		}
 	}
 }
 
-func handleRoomOperation(conn *websocket.Conn, clientId string, roomId string) {
+func handleRoomOperation(conn *websocket.Conn, ip string, clientId string, roomId string, isCreate bool) {
 	clientsMu.Lock()
-	clients[clientId] = NewClient(clientId, roomId, conn)
+	if existing, ok := clients[clientId]; ok {
+		clientsMu.Unlock()
+		if existing.RoomId == roomId {
+			closeConnWithErr(conn, &ProtocolError{Message: fmt.Sprintf("already joined room %s", roomId)})
+		} else {
+			closeConnWithErr(conn, &ProtocolError{Message: fmt.Sprintf("clientId %s is already in use", clientId)})
+		}
+		return
+	}
+
+	room, exists := rooms[roomId]
+	if isCreate && !exists {
+		room = &Room{Op: clientId}
+		rooms[roomId] = room
+	} else if isCreate && room.Op == "" {
+		// The room was created op-less by an earlier token join whose
+		// token didn't grant op (e.g. an observer invite that happened
+		// to connect first); the real host's createRoom still claims it.
+		room.Op = clientId
+	}
+	isOp := room != nil && room.Op == clientId
+
+	client := NewClient(clientId, roomId, conn)
+	client.Permissions = defaultPermissions(isOp)
+	client.IP = ip
+	clients[clientId] = client
 	clientsMu.Unlock()
 
-	log.Printf("Client %s joined room %s", clientId, roomId)
+	log.Printf("Client %s (%s) joined room %s (op=%v)", clientId, ip, roomId, isOp)
+	sendICEServers(client)
 	broadcastClientsInRoom(roomId, []string{clientId})
+	sendChatBacklog(client)
+}
+
+// handleJoinRoomWithToken admits a client on the strength of a signed
+// room token rather than a bare clientId/roomId pair, so permissions
+// come from the token issuer (see /token in token.go) instead of being
+// whatever the client claims for itself.
+func handleJoinRoomWithToken(conn *websocket.Conn, ip string, msg Message) {
+	claims, err := verifyRoomToken(msg.Token)
+	if err != nil {
+		log.Printf("Rejecting joinRoomWithToken for %s: %v", msg.ClientId, err)
+		closeConnWithErr(conn, &UserError{Message: err.Error()})
+		return
+	}
+	if claims.ClientId != msg.ClientId {
+		log.Printf("Token clientId %s does not match message clientId %s", claims.ClientId, msg.ClientId)
+		closeConnWithErr(conn, &UserError{Message: "clientId mismatch"})
+		return
+	}
+
+	clientsMu.Lock()
+	if existing, ok := clients[claims.ClientId]; ok {
+		clientsMu.Unlock()
+		if existing.RoomId == claims.RoomId {
+			closeConnWithErr(conn, &ProtocolError{Message: fmt.Sprintf("already joined room %s", claims.RoomId)})
+		} else {
+			closeConnWithErr(conn, &ProtocolError{Message: fmt.Sprintf("clientId %s is already in use", claims.ClientId)})
+		}
+		return
+	}
+	// Only burn the token's one-shot nonce once we know the join will
+	// actually succeed, so a retry racing a stale clients-map entry
+	// doesn't waste an otherwise-valid token.
+	if !consumeTokenNonce(claims.Nonce, claims.Exp) {
+		clientsMu.Unlock()
+		closeConnWithErr(conn, &UserError{Message: "token already used"})
+		return
+	}
+	if _, exists := rooms[claims.RoomId]; !exists {
+		// Only claim the op slot if the token actually grants it —
+		// an observer token joining first must not permanently lock
+		// out the real host's later plain createRoom for this room id.
+		room := &Room{}
+		if contains(claims.Permissions, PermissionOp) {
+			room.Op = claims.ClientId
+		}
+		rooms[claims.RoomId] = room
+	}
+	client := NewClient(claims.ClientId, claims.RoomId, conn)
+	client.Permissions = claims.Permissions
+	client.IP = ip
+	clients[claims.ClientId] = client
+	clientsMu.Unlock()
+
+	log.Printf("Client %s (%s) joined room %s via token", claims.ClientId, ip, claims.RoomId)
+	sendICEServers(client)
+	broadcastClientsInRoom(claims.RoomId, []string{claims.ClientId})
+	sendChatBacklog(client)
 }
 
-func sendClientList(conn *websocket.Conn, roomId string) {
+func sendClientList(clientId string, roomId string) {
 	clientsMu.Lock()
+	requester := clients[clientId]
 	clientList := make([]string, 0)
+	clientPermissions := make(map[string][]string)
 	for id, client := range clients {
 		if client.RoomId == roomId {
 			clientList = append(clientList, id)
+			clientPermissions[id] = client.Permissions
 		}
 	}
 	clientsMu.Unlock()
 
-	msg := Message{Type: TypeClients, Clients: clientList}
+	if requester == nil {
+		log.Printf("getClients from unknown client %s", clientId)
+		return
+	}
+
+	msg := Message{Type: TypeClients, Clients: clientList, ClientPermissions: clientPermissions}
 	msgBytes, _ := json.Marshal(msg)
-	conn.WriteMessage(websocket.TextMessage, msgBytes)
+	requester.enqueue(msgBytes)
 }
 
 func forwardMessage(senderID string, msg Message) {
 	clientsMu.Lock()
+	sender := clients[senderID]
 	targetClient, exists := clients[msg.ClientId]
 	clientsMu.Unlock()
 
 	msg.SenderId = senderID
 
-	if exists && targetClient != nil {
+	if isSignalingType(msg.Type) && !sender.hasPermission(PermissionPresent) {
+		log.Printf("Client %s lacks %s, refusing to forward %s", senderID, PermissionPresent, msg.Type)
+		denyAction(sender, string(msg.Type))
+		return
+	}
+
+	if exists && targetClient != nil && sender != nil && targetClient.RoomId == sender.RoomId {
 		log.Printf("Forwarding %s from %s to %s", msg.Type, msg.SenderId, msg.ClientId)
-		targetClient.Conn.WriteJSON(msg)
-	} else {
-		log.Printf("Unable to forward message to client %s", msg.ClientId)
+		targetClient.enqueue(msg)
+		return
+	}
+
+	if exists && targetClient != nil && sender != nil {
+		// The target is a live client, just not in the sender's room.
+		log.Printf("Client %s tried to forward %s to %s outside its room", senderID, msg.Type, msg.ClientId)
+		closeClientWithErr(sender, &ProtocolError{Message: fmt.Sprintf("no such client in room: %s", msg.ClientId)})
+		return
+	}
+
+	// The target isn't in the clients map at all (never joined, or has
+	// already disconnected): that is a protocol error for the sender too.
+	log.Printf("Unable to forward message to client %s: no such client", msg.ClientId)
+	closeClientWithErr(sender, &ProtocolError{Message: fmt.Sprintf("no such client: %s", msg.ClientId)})
+}
+
+func isSignalingType(t MessageType) bool {
+	return t == TypeOffer || t == TypeAnswer || t == TypeCandidate
+}
+
+func handleSetPermissions(senderID string, msg Message) {
+	clientsMu.Lock()
+	sender := clients[senderID]
+	target := clients[msg.ClientId]
+	clientsMu.Unlock()
+
+	if !sender.hasPermission(PermissionOp) || target == nil || target.RoomId != sender.RoomId {
+		denyAction(sender, string(TypeSetPermissions))
+		return
+	}
+
+	clientsMu.Lock()
+	target.Permissions = msg.Permissions
+	clientsMu.Unlock()
+
+	log.Printf("Client %s set permissions of %s to %v", senderID, target.Id, msg.Permissions)
+	broadcastClientsInRoom(target.RoomId, nil)
+}
+
+func handleKick(senderID string, msg Message) {
+	clientsMu.Lock()
+	sender := clients[senderID]
+	target := clients[msg.ClientId]
+	clientsMu.Unlock()
+
+	if !sender.hasPermission(PermissionOp) || target == nil || target.RoomId != sender.RoomId {
+		denyAction(sender, string(TypeKick))
+		return
 	}
+
+	log.Printf("Client %s kicked by op %s", target.Id, senderID)
+	closeClientWithErr(target, &KickError{Message: fmt.Sprintf("kicked by %s", senderID)})
 }
 
 func handleClientDisconnection(conn *websocket.Conn) {
@@ -162,7 +506,9 @@ func handleClientDisconnection(conn *websocket.Conn) {
 	roomId := client.RoomId
 
 	// Удаляем клиента
+	client.evict()
 	delete(clients, clientId)
+	clearChatLimiter(clientId)
 	log.Printf("Client disconnected: %s from room: %s", clientId, roomId)
 
 	// Отправляем обновленный список клиентов остальным участникам комнаты
@@ -180,36 +526,45 @@ func broadcastClientsInRoom(roomId string, excludeClients []string) {
 	}
 
 	clientsMu.Lock()
-	defer clientsMu.Unlock()
-
-	// Собираем список клиентов в комнате
+	// Собираем список клиентов в комнате вместе с их правами
 	clientList := make([]string, 0)
+	clientPermissions := make(map[string][]string)
 	for id, client := range clients {
 		if client != nil && client.RoomId == roomId {
 			clientList = append(clientList, id)
+			clientPermissions[id] = client.Permissions
 		}
 	}
+	clientsMu.Unlock()
+
+	broadcastToRoom(roomId, Message{Type: TypeClients, Clients: clientList, ClientPermissions: clientPermissions}, excludeClients)
+}
+
+// broadcastToRoom marshals msg once and enqueues it on every client in
+// roomId except those in exclude, so one slow peer's write pump can't
+// hold up delivery to the rest of the room.
+func broadcastToRoom(roomId string, msg Message, exclude []string) {
+	if roomId == "" {
+		return
+	}
 
-	// Создаем сообщение
-	message := Message{Type: TypeClients, Clients: clientList}
-	msgBytes, err := json.Marshal(message)
+	msgBytes, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("Error marshaling clients message: %v", err)
+		log.Printf("Error marshaling %s message: %v", msg.Type, err)
 		return
 	}
 
-	// Отправляем сообщение всем клиентам в комнате
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
 	for _, client := range clients {
 		if client == nil ||
 			client.RoomId != roomId ||
-			contains(excludeClients, client.Id) {
+			contains(exclude, client.Id) {
 			continue
 		}
 
-		err := client.Conn.WriteMessage(websocket.TextMessage, msgBytes)
-		if err != nil {
-			log.Printf("Error sending message to client %s: %v", client.Id, err)
-		}
+		client.enqueue(msgBytes)
 	}
 }
 
@@ -238,3 +593,42 @@ func getEnv(key, fallback string) string {
 	}
 	return value
 }
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s=%q, using default %s: %v", key, value, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Invalid float for %s=%q, using default %v: %v", key, value, fallback, err)
+		return fallback
+	}
+	return f
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid int for %s=%q, using default %d: %v", key, value, fallback, err)
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient upgrades a real WebSocket connection (so writer() has a
+// genuine *websocket.Conn to write to/close) and wraps it in a Client,
+// mirroring what handleRoomOperation does on a real join. The dialer side
+// is drained in the background so enqueue never blocks the test on a full
+// buffer.
+func newTestClient(t *testing.T, id, roomId string) *Client {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	serverConnCh := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConnCh <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	dialerConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { dialerConn.Close() })
+	go func() {
+		for {
+			if _, _, err := dialerConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	serverConn := <-serverConnCh
+	client := NewClient(id, roomId, serverConn)
+	t.Cleanup(client.evict)
+	return client
+}
+
+// resetRoomState clears the package-level clients/rooms maps so each
+// subtest starts from a clean slate despite them being shared globals.
+func resetRoomState(t *testing.T) {
+	t.Helper()
+	clientsMu.Lock()
+	clients = make(map[string]*Client)
+	clientsMu.Unlock()
+	rooms = make(map[string]*Room)
+}
+
+func registerTestClient(c *Client) {
+	clientsMu.Lock()
+	clients[c.Id] = c
+	clientsMu.Unlock()
+}
+
+func TestSetPermissionsAuthorization(t *testing.T) {
+	tests := []struct {
+		name           string
+		senderPerms    []string
+		targetRoom     string
+		wantTargetKept bool
+	}{
+		{
+			name:           "op can set another client's permissions",
+			senderPerms:    []string{PermissionOp, PermissionPresent},
+			targetRoom:     "room1",
+			wantTargetKept: false,
+		},
+		{
+			name:           "non-op is denied",
+			senderPerms:    []string{PermissionPresent},
+			targetRoom:     "room1",
+			wantTargetKept: true,
+		},
+		{
+			name:           "op cannot reach a client in a different room",
+			senderPerms:    []string{PermissionOp, PermissionPresent},
+			targetRoom:     "room2",
+			wantTargetKept: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRoomState(t)
+
+			sender := newTestClient(t, "sender", "room1")
+			sender.Permissions = tt.senderPerms
+			registerTestClient(sender)
+
+			target := newTestClient(t, "target", tt.targetRoom)
+			target.Permissions = []string{PermissionPresent}
+			registerTestClient(target)
+
+			handleSetPermissions("sender", Message{
+				Type:        TypeSetPermissions,
+				ClientId:    "target",
+				Permissions: []string{},
+			})
+
+			clientsMu.Lock()
+			got := clients["target"].Permissions
+			clientsMu.Unlock()
+
+			if tt.wantTargetKept && len(got) != 1 {
+				t.Fatalf("expected target's permissions untouched, got %v", got)
+			}
+			if !tt.wantTargetKept && len(got) != 0 {
+				t.Fatalf("expected target's permissions cleared, got %v", got)
+			}
+		})
+	}
+}
+
+func TestHandleKickAuthorization(t *testing.T) {
+	t.Run("op can kick a client in the same room", func(t *testing.T) {
+		resetRoomState(t)
+
+		op := newTestClient(t, "op", "room1")
+		op.Permissions = []string{PermissionOp, PermissionPresent}
+		registerTestClient(op)
+
+		target := newTestClient(t, "target", "room1")
+		target.Permissions = []string{PermissionPresent}
+		registerTestClient(target)
+
+		handleKick("op", Message{Type: TypeKick, ClientId: "target"})
+
+		target.writeMu.RLock()
+		closed := target.closed
+		target.writeMu.RUnlock()
+		if !closed {
+			t.Fatal("expected kicked target's write pump to be closed")
+		}
+	})
+
+	t.Run("non-op cannot kick", func(t *testing.T) {
+		resetRoomState(t)
+
+		sender := newTestClient(t, "sender", "room1")
+		sender.Permissions = []string{PermissionPresent}
+		registerTestClient(sender)
+
+		target := newTestClient(t, "target", "room1")
+		target.Permissions = []string{PermissionPresent}
+		registerTestClient(target)
+
+		handleKick("sender", Message{Type: TypeKick, ClientId: "target"})
+
+		target.writeMu.RLock()
+		closed := target.closed
+		target.writeMu.RUnlock()
+		if closed {
+			t.Fatal("expected target to remain connected when kicked by a non-op")
+		}
+	})
+}
+
+func TestForwardMessagePermissionGate(t *testing.T) {
+	t.Run("client without present is denied and closed", func(t *testing.T) {
+		resetRoomState(t)
+
+		sender := newTestClient(t, "sender", "room1")
+		sender.Permissions = []string{} // observer: no present
+		registerTestClient(sender)
+
+		target := newTestClient(t, "target", "room1")
+		target.Permissions = []string{PermissionPresent}
+		registerTestClient(target)
+
+		forwardMessage("sender", Message{Type: TypeOffer, ClientId: "target"})
+
+		sender.writeMu.RLock()
+		closed := sender.closed
+		sender.writeMu.RUnlock()
+		if !closed {
+			t.Fatal("expected sender lacking present to be denied/closed")
+		}
+	})
+
+	t.Run("client with present can forward to a peer in the same room", func(t *testing.T) {
+		resetRoomState(t)
+
+		sender := newTestClient(t, "sender", "room1")
+		sender.Permissions = []string{PermissionPresent}
+		registerTestClient(sender)
+
+		target := newTestClient(t, "target", "room1")
+		target.Permissions = []string{PermissionPresent}
+		registerTestClient(target)
+
+		forwardMessage("sender", Message{Type: TypeOffer, ClientId: "target"})
+
+		sender.writeMu.RLock()
+		closed := sender.closed
+		sender.writeMu.RUnlock()
+		if closed {
+			t.Fatal("expected a permitted forward to leave the sender connected")
+		}
+	})
+}
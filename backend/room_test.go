@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+// TestRoomOpAssignment covers the interaction between the op model
+// (chunk0-2) and room admission: whichever path creates a room's Room
+// entry must only set Op when the admitted client actually holds
+// PermissionOp, and a later createRoom must still be able to claim an
+// op-less room left behind by an earlier token join (see
+// handleJoinRoomWithToken in main.go).
+func TestRoomOpAssignment(t *testing.T) {
+	t.Run("first createRoom claims op", func(t *testing.T) {
+		resetRoomState(t)
+		alice := newTestClient(t, "alice", "")
+
+		handleRoomOperation(alice.Conn, "1.2.3.4", "alice", "room1", true)
+
+		if rooms["room1"] == nil || rooms["room1"].Op != "alice" {
+			t.Fatalf("expected alice to be op of room1, got %+v", rooms["room1"])
+		}
+		clientsMu.Lock()
+		got := clients["alice"].Permissions
+		clientsMu.Unlock()
+		if !contains(got, PermissionOp) {
+			t.Fatalf("expected alice to hold %s, got %v", PermissionOp, got)
+		}
+	})
+
+	t.Run("joinRoom does not grant op to a second client", func(t *testing.T) {
+		resetRoomState(t)
+		rooms["room1"] = &Room{Op: "alice"}
+
+		bob := newTestClient(t, "bob", "")
+		handleRoomOperation(bob.Conn, "1.2.3.4", "bob", "room1", false)
+
+		clientsMu.Lock()
+		got := clients["bob"].Permissions
+		clientsMu.Unlock()
+		if contains(got, PermissionOp) {
+			t.Fatalf("expected bob to not hold %s, got %v", PermissionOp, got)
+		}
+	})
+
+	t.Run("createRoom claims an op-less room left behind by an observer token join", func(t *testing.T) {
+		resetRoomState(t)
+		// Simulates handleJoinRoomWithToken admitting an observer (no
+		// PermissionOp) before the room existed: it must leave Op empty.
+		rooms["room1"] = &Room{}
+
+		host := newTestClient(t, "host", "")
+		handleRoomOperation(host.Conn, "1.2.3.4", "host", "room1", true)
+
+		if rooms["room1"].Op != "host" {
+			t.Fatalf("expected host to claim the op-less room, got Op=%q", rooms["room1"].Op)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room tokens are a compact JWT-like header.payload.sig string, signed
+// HS256 with ROOM_TOKEN_SECRET, so joinRoomWithToken doesn't need to
+// trust whatever roomId/permissions the client claims for itself.
+var (
+	roomTokenSecret  = []byte(getEnv("ROOM_TOKEN_SECRET", ""))
+	adminTokenSecret = getEnv("ADMIN_TOKEN_SECRET", "")
+)
+
+const roomTokenHeader = `{"alg":"HS256","typ":"RT"}`
+
+type RoomTokenClaims struct {
+	RoomId      string   `json:"roomId"`
+	ClientId    string   `json:"clientId"`
+	Permissions []string `json:"permissions"`
+	Nonce       string   `json:"nonce"`
+	Exp         int64    `json:"exp"`
+	Nbf         int64    `json:"nbf"`
+}
+
+// generateNonce returns a fresh random token identifier for Nonce, so
+// consumeTokenNonce has something unguessable to key a token's
+// one-time redemption on.
+func generateNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// usedTokenNonces records which room-token nonces have already been
+// redeemed, so a captured/logged token can't be replayed to rejoin a
+// room after the legitimate client has used it once.
+var (
+	usedTokenNoncesMu sync.Mutex
+	usedTokenNonces   = make(map[string]int64) // nonce -> claimed Exp
+)
+
+// consumeTokenNonce reports whether nonce hasn't been redeemed before,
+// recording it if so. Each entry stores the token's own Exp so it can
+// be swept once that token would be rejected by the expiry check
+// anyway, keeping the map from growing without bound.
+func consumeTokenNonce(nonce string, exp int64) bool {
+	usedTokenNoncesMu.Lock()
+	defer usedTokenNoncesMu.Unlock()
+
+	now := time.Now().Unix()
+	for n, e := range usedTokenNonces {
+		if e != 0 && now >= e {
+			delete(usedTokenNonces, n)
+		}
+	}
+
+	if _, redeemed := usedTokenNonces[nonce]; redeemed {
+		return false
+	}
+	usedTokenNonces[nonce] = exp
+	return true
+}
+
+func signRoomToken(claims RoomTokenClaims) (string, error) {
+	if len(roomTokenSecret) == 0 {
+		return "", errors.New("ROOM_TOKEN_SECRET is not configured")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(roomTokenHeader)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := hmacSHA256(roomTokenSecret, signingInput)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func verifyRoomToken(token string) (*RoomTokenClaims, error) {
+	if len(roomTokenSecret) == 0 {
+		return nil, errors.New("ROOM_TOKEN_SECRET is not configured")
+	}
+
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	gotSig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	wantSig := hmacSHA256(roomTokenSecret, parts[0]+"."+parts[1])
+	if subtle.ConstantTimeCompare(wantSig, gotSig) != 1 {
+		return nil, errors.New("invalid signature")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed payload: %w", err)
+	}
+	var claims RoomTokenClaims
+	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+
+	now := time.Now().Unix()
+	if claims.Exp != 0 && now >= claims.Exp {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Nonce == "" {
+		return nil, errors.New("missing nonce")
+	}
+	return &claims, nil
+}
+
+func hmacSHA256(secret []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// handleMintToken is the admin endpoint external apps call to hand out
+// one-shot room invites without talking to the signaling server's room
+// state directly. It is guarded by its own secret, separate from
+// ROOM_TOKEN_SECRET, so a leaked room token can't be used to mint more.
+func handleMintToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAuthorizedAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		RoomId      string   `json:"roomId"`
+		ClientId    string   `json:"clientId"`
+		Permissions []string `json:"permissions"`
+		TTLSeconds  int64    `json:"ttlSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RoomId == "" || req.ClientId == "" {
+		http.Error(w, "roomId and clientId are required", http.StatusBadRequest)
+		return
+	}
+	ttl := req.TTLSeconds
+	if ttl <= 0 {
+		ttl = 300
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().Unix()
+	token, err := signRoomToken(RoomTokenClaims{
+		RoomId:      req.RoomId,
+		ClientId:    req.ClientId,
+		Permissions: req.Permissions,
+		Nonce:       nonce,
+		Nbf:         now,
+		Exp:         now + ttl,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+func isAuthorizedAdmin(r *http.Request) bool {
+	if adminTokenSecret == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(adminTokenSecret)) == 1
+}
+
+type roomStats struct {
+	RoomId  string       `json:"roomId"`
+	Clients []clientStat `json:"clients"`
+}
+
+type clientStat struct {
+	ClientId string `json:"clientId"`
+	IP       string `json:"ip"`
+}
+
+// handleStats is the admin counterpart to handleMintToken: instead of
+// minting access, it reports who currently has it, so an operator can
+// see the resolved IP behind any client without trusting that client's
+// own claims.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAuthorizedAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	clientsMu.Lock()
+	byRoom := make(map[string][]clientStat)
+	for _, c := range clients {
+		byRoom[c.RoomId] = append(byRoom[c.RoomId], clientStat{ClientId: c.Id, IP: c.IP})
+	}
+	clientsMu.Unlock()
+
+	stats := make([]roomStats, 0, len(byRoom))
+	for roomId, roomClients := range byRoom {
+		stats = append(stats, roomStats{RoomId: roomId, Clients: roomClients})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	roomTokenSecret = []byte("test-room-token-secret")
+	os.Exit(m.Run())
+}
+
+func mintTestToken(t *testing.T, exp, nbf int64) string {
+	t.Helper()
+	nonce, err := generateNonce()
+	if err != nil {
+		t.Fatalf("generateNonce: %v", err)
+	}
+	token, err := signRoomToken(RoomTokenClaims{
+		RoomId:      "room1",
+		ClientId:    "alice",
+		Permissions: []string{PermissionPresent},
+		Nonce:       nonce,
+		Exp:         exp,
+		Nbf:         nbf,
+	})
+	if err != nil {
+		t.Fatalf("signRoomToken: %v", err)
+	}
+	return token
+}
+
+func TestVerifyRoomToken(t *testing.T) {
+	now := time.Now().Unix()
+
+	t.Run("valid token verifies", func(t *testing.T) {
+		token := mintTestToken(t, now+60, 0)
+		claims, err := verifyRoomToken(token)
+		if err != nil {
+			t.Fatalf("verifyRoomToken: unexpected error: %v", err)
+		}
+		if claims.RoomId != "room1" || claims.ClientId != "alice" {
+			t.Fatalf("unexpected claims: %+v", claims)
+		}
+	})
+
+	t.Run("missing nonce is rejected", func(t *testing.T) {
+		token, err := signRoomToken(RoomTokenClaims{RoomId: "room1", ClientId: "alice", Exp: now + 60})
+		if err != nil {
+			t.Fatalf("signRoomToken: %v", err)
+		}
+		if _, err := verifyRoomToken(token); err == nil {
+			t.Fatal("expected error for token with no nonce")
+		}
+	})
+
+	t.Run("expired token is rejected", func(t *testing.T) {
+		token := mintTestToken(t, now-1, 0)
+		if _, err := verifyRoomToken(token); err == nil {
+			t.Fatal("expected error for expired token")
+		}
+	})
+
+	t.Run("not-yet-valid token is rejected", func(t *testing.T) {
+		token := mintTestToken(t, now+60, now+30)
+		if _, err := verifyRoomToken(token); err == nil {
+			t.Fatal("expected error for not-yet-valid token")
+		}
+	})
+
+	t.Run("garbled token is rejected", func(t *testing.T) {
+		token := mintTestToken(t, now+60, 0)
+		if _, err := verifyRoomToken(token + "tampered"); err == nil {
+			t.Fatal("expected error for tampered token")
+		}
+	})
+
+	t.Run("malformed token is rejected", func(t *testing.T) {
+		if _, err := verifyRoomToken("not-a-token"); err == nil {
+			t.Fatal("expected error for malformed token")
+		}
+	})
+
+	t.Run("wrong secret is rejected", func(t *testing.T) {
+		saved := roomTokenSecret
+		roomTokenSecret = []byte("a-different-secret")
+		token := mintTestToken(t, now+60, 0)
+		roomTokenSecret = saved
+
+		if _, err := verifyRoomToken(token); err == nil {
+			t.Fatal("expected error for token signed with a different secret")
+		}
+	})
+}
+
+func TestConsumeTokenNonce(t *testing.T) {
+	now := time.Now().Unix()
+	nonce := "nonce-under-test"
+
+	if !consumeTokenNonce(nonce, now+60) {
+		t.Fatal("first redemption should succeed")
+	}
+	if consumeTokenNonce(nonce, now+60) {
+		t.Fatal("second redemption of the same nonce should be rejected")
+	}
+}